@@ -1,5 +1,7 @@
 package gonameko
 
+import "context"
+
 // Client use to initiate a go nameko client
 type Client struct {
 	RabbitHostname string
@@ -7,6 +9,14 @@ type Client struct {
 	RabbitPass     string
 	RabbitPort     int64
 	ContentType    string
+	// UseNumber decode numbers in results as json.Number to keep int64 precision
+	UseNumber bool
+	// Errors map remote exceptions to Go errors, DefaultErrorRegistry is used
+	// when nil
+	Errors *ErrorRegistry
+	// ContextData is sent as nameko context data with every call, e.g.
+	// {"language": "en"}
+	ContextData map[string]interface{}
 
 	Conn *Connection
 }
@@ -17,7 +27,30 @@ func (c *Client) Call(p RPCRequestParam) (interface{}, error) {
 	return response, err
 }
 
-func (c *Client) Setup() {
+// CallContext is like Call but honours the deadline and cancellation of ctx
+func (c *Client) CallContext(ctx context.Context, p RPCRequestParam) (interface{}, error) {
+	return c.Conn.CallContext(ctx, p)
+}
+
+// CallInto publish a message to nameko service and decode the result into
+// out, e.g. a pointer to a struct matching the returned dict
+func (c *Client) CallInto(ctx context.Context, p RPCRequestParam, out interface{}) error {
+	return c.Conn.CallInto(ctx, p, out)
+}
+
+// CallAsync publish a message to nameko service and return immediately, the
+// response is collected from the returned Reply
+func (c *Client) CallAsync(p RPCRequestParam) *Reply {
+	return c.Conn.CallAsync(p)
+}
+
+// CallAsyncContext is like CallAsync but send the context data carried by ctx
+func (c *Client) CallAsyncContext(ctx context.Context, p RPCRequestParam) *Reply {
+	return c.Conn.CallAsyncContext(ctx, p)
+}
+
+// Setup connect the client to RabbitMQ
+func (c *Client) Setup() error {
 	c.Conn = &Connection{
 		Name:           "gonameko-client",
 		RabbitHostname: c.RabbitHostname,
@@ -25,6 +58,14 @@ func (c *Client) Setup() {
 		RabbitPass:     c.RabbitPass,
 		RabbitPort:     c.RabbitPort,
 		ContentType:    c.ContentType,
+		UseNumber:      c.UseNumber,
+		Errors:         c.Errors,
+		ContextData:    c.ContextData,
 	}
-	c.Conn.Declare()
+	return c.Conn.Declare()
+}
+
+// Close close the connection of the client, pending calls fail
+func (c *Client) Close() error {
+	return c.Conn.Close()
 }
@@ -1,9 +1,11 @@
 package gonameko
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/streadway/amqp"
@@ -16,54 +18,72 @@ type Connection struct {
 	RabbitPass     string
 	RabbitPort     int64
 	ContentType    string
+	// UseNumber decode numbers in results as json.Number instead of float64
+	UseNumber bool
+	// Errors translate remote errors, DefaultErrorRegistry is used when nil
+	Errors *ErrorRegistry
+	// ContextData is sent as nameko context data with every call, see
+	// RPCRequestParam.ContextData
+	ContextData map[string]interface{}
+	// PrefetchCount limit the unacked messages delivered by Serve and
+	// ConsumeEvents, shared by all their consumers, 10 when not set
+	PrefetchCount int
 
 	conn    *amqp.Connection
 	channel *amqp.Channel
 	queue   amqp.Queue
 	server  amqp.Queue
-	msgs    <-chan amqp.Delivery
-}
+	replies *replyDispatcher
 
-// RPCError capture exception from nameko service
-type RPCError struct {
-	ExcArgs string `json:"exc_args"`
-	ExcPath string `json:"exc_path"`
-	ExcType string `json:"exc_type"`
-	Value   string `json:"value"`
-}
+	mu        sync.Mutex
+	consumers []string
+	cancelled bool
 
-// Error represent gonamekoclient customize error
-type Error struct {
-	Type, Value string
+	declareMu sync.Mutex
+	declared  map[string]bool
 }
 
-// RPCPayload define arguments accept by nameko service
+// RPCPayload define arguments accept by nameko service, any value that
+// encoding/json can marshal is allowed including structs with json tags
 type RPCPayload struct {
-	Args   []string          `json:"args"`
-	Kwargs map[string]string `json:"kwargs"`
+	Args   []interface{}          `json:"args"`
+	Kwargs map[string]interface{} `json:"kwargs"`
 }
 
 // RPCRequestParam define nameko service and function, arguments
 type RPCRequestParam struct {
 	Service, Function string
 	Payload           RPCPayload
+	// ContextData is sent as nameko context data such as user_id or
+	// auth_token, it override the data of the client and of the context
+	ContextData map[string]interface{}
 }
 
-// RPCResponse Use to parse resposne from nameko service
+// RPCResponse Use to parse resposne from nameko service, Result is kept raw
+// so it can be decoded into the type expected by the caller
 type RPCResponse struct {
-	Result interface{}       `json:"result"`
-	Err    map[string]string `json:"error"`
+	Result json.RawMessage `json:"result"`
+	Err    *RPCError       `json:"error"`
 }
 
-func (e *RPCError) Error() string {
-	return fmt.Sprintf("%v: %v", e.ExcType, e.Value)
-}
-
-func (e *Error) Error() string {
-	return fmt.Sprintf("%v: %v", e.Type, e.Value)
+// MarshalJSON always encode args as a list and kwargs as a dict, nameko
+// reject a request where either of them is null
+func (p RPCPayload) MarshalJSON() ([]byte, error) {
+	args, kwargs := p.Args, p.Kwargs
+	if args == nil {
+		args = []interface{}{}
+	}
+	if kwargs == nil {
+		kwargs = map[string]interface{}{}
+	}
+	return json.Marshal(struct {
+		Args   []interface{}          `json:"args"`
+		Kwargs map[string]interface{} `json:"kwargs"`
+	}{args, kwargs})
 }
 
-func (c *Connection) Declare() {
+// Declare connect to RabbitMQ and set up the reply queue used by calls
+func (c *Connection) Declare() (err error) {
 	amqpURI := fmt.Sprintf(
 		"amqp://%v:%v@%v:%v/",
 		c.RabbitUser,
@@ -72,11 +92,21 @@ func (c *Connection) Declare() {
 		c.RabbitPort,
 	)
 	conn, err := amqp.Dial(amqpURI)
-	FailOnError(err, "Failed to connect to RabbitMQ")
+	if err != nil {
+		return wrapError(ErrConnect, "Failed to connect to RabbitMQ", err)
+	}
 	c.conn = conn
+	defer func() {
+		if err != nil {
+			conn.Close()
+			c.conn = nil
+		}
+	}()
 
 	ch, err := conn.Channel()
-	FailOnError(err, "Failed to open a channel")
+	if err != nil {
+		return wrapError(ErrConnect, "Failed to open a channel", err)
+	}
 	c.channel = ch
 
 	err = ch.ExchangeDeclare(
@@ -88,7 +118,9 @@ func (c *Connection) Declare() {
 		false,        // no-wait
 		nil,          // arguments
 	)
-	FailOnError(err, "Failed to declare an exchange")
+	if err != nil {
+		return wrapError(ErrDeclare, "Failed to declare an exchange", err)
+	}
 
 	q, err := ch.QueueDeclare(
 		fmt.Sprintf("rpc.reply-%v-%v", c.Name, uuid.NewV4().String()), // name
@@ -98,7 +130,9 @@ func (c *Connection) Declare() {
 		false, // no-wait
 		nil,   // arguments
 	)
-	FailOnError(err, "Failed to declare a client queue")
+	if err != nil {
+		return wrapError(ErrDeclare, "Failed to declare a client queue", err)
+	}
 	c.queue = q
 
 	err = ch.QueueBind(
@@ -108,9 +142,18 @@ func (c *Connection) Declare() {
 		false,        // no-wait
 		nil,          // args
 	)
-	FailOnError(err, "Failed to bind a client queue")
+	if err != nil {
+		return wrapError(ErrDeclare, "Failed to bind a client queue", err)
+	}
 
-	msgs, err := ch.Consume(
+	// replies are consumed on their own channel so that they are not held
+	// back by the prefetch limit of the server consumers
+	replyCh, err := conn.Channel()
+	if err != nil {
+		return wrapError(ErrConnect, "Failed to open a channel", err)
+	}
+
+	msgs, err := replyCh.Consume(
 		c.queue.Name, // queue
 		"",           // consumer
 		false,        // auto ack
@@ -119,116 +162,253 @@ func (c *Connection) Declare() {
 		false,        // no wait
 		nil,          // args
 	)
-	FailOnError(err, "Failed to register a consumer")
-	c.msgs = msgs
+	if err != nil {
+		return wrapError(ErrConsume, "Failed to register a consumer", err)
+	}
+
+	c.replies = newReplyDispatcher()
+	go c.replies.listen(msgs)
+	return nil
 }
 
+// Call publish p to nameko service and wait for the reply with the same
+// correlation id, it is safe to call from multiple goroutines
 func (c *Connection) Call(p RPCRequestParam) (interface{}, error) {
-	response := &RPCResponse{}
-	correlationID := uuid.NewV4().String()
-
-	go func() {
-		param, _ := json.Marshal(p.Payload)
-
-		err := c.channel.Publish(
-			"nameko-rpc", // exchange
-			fmt.Sprintf("%v.%v", p.Service, p.Function), // routing key
-			false, // mandatory
-			false, // immediate
-			amqp.Publishing{
-				ContentType:   c.ContentType,
-				CorrelationId: correlationID,
-				ReplyTo:       c.queue.Name,
-				Body:          []byte(string(param)),
-			})
-		FailOnError(err, "Failed to publish a message")
-	}()
+	return c.CallContext(context.Background(), p)
+}
 
-	d := <-c.msgs
-	if d.CorrelationId == correlationID {
-		json.Unmarshal(d.Body, response)
+// CallContext is like Call but stop waiting for the reply once ctx is done,
+// a late reply is dropped by the reply listener
+func (c *Connection) CallContext(ctx context.Context, p RPCRequestParam) (interface{}, error) {
+	reply := c.CallAsyncContext(ctx, p)
+	return reply.Result(ctx)
+}
 
-		log.Println(response)
+// CallInto is like CallContext but decode the result into out, which must be
+// a pointer as for json.Unmarshal
+func (c *Connection) CallInto(ctx context.Context, p RPCRequestParam, out interface{}) error {
+	reply := c.CallAsyncContext(ctx, p)
+	return reply.ResultInto(ctx, out)
+}
 
-		if response.Err != nil {
-			d.Ack(false)
-			return nil, &RPCError{response.Err["exc_path"], response.Err["exc_args"], response.Err["exc_type"], response.Err["value"]}
-		}
+// CallAsync publish p to nameko service without waiting, the returned Reply
+// is used to collect the response later
+func (c *Connection) CallAsync(p RPCRequestParam) *Reply {
+	return c.CallAsyncContext(context.Background(), p)
+}
 
-		d.Ack(false)
-		return response.Result, nil
+// CallAsyncContext is like CallAsync but send the context data carried by
+// ctx, ctx is not used to wait for the reply
+func (c *Connection) CallAsyncContext(ctx context.Context, p RPCRequestParam) *Reply {
+	param, err := json.Marshal(p.Payload)
+	if err != nil {
+		return failedReply(p, err)
+	}
+
+	registry := c.Errors
+	if registry == nil {
+		registry = DefaultErrorRegistry
+	}
+	reply := &Reply{
+		Service:       p.Service,
+		Function:      p.Function,
+		correlationID: uuid.NewV4().String(),
+		useNumber:     c.UseNumber,
+		registry:      registry,
+	}
+	c.replies.register(reply)
+
+	err = c.channel.Publish(
+		"nameko-rpc", // exchange
+		fmt.Sprintf("%v.%v", p.Service, p.Function), // routing key
+		false, // mandatory
+		false, // immediate
+		amqp.Publishing{
+			ContentType:   c.ContentType,
+			CorrelationId: reply.correlationID,
+			ReplyTo:       c.queue.Name,
+			Headers:       contextHeaders(ctx, c.Name, c.ContextData, p.ContextData),
+			Body:          []byte(string(param)),
+		})
+	if err != nil {
+		c.replies.unregister(reply.correlationID)
+		return failedReply(p, wrapError(ErrPublish, "Failed to publish a message", err))
 	}
-	return nil, &Error{"INVALID_CORRELATION_ID", "invalid correlation id"}
 
+	return reply
 }
 
-func (c *Connection) Serve(name string) {
+// Serve consume rpc messages for the service called name and pass them to
+// handle, it return when handle or consuming fails or the channel is closed,
+// and return nil once the consumer is stopped by Cancel
+func (c *Connection) Serve(name string, handle func(amqp.Delivery) error) error {
+	msgs, err := c.Consume(name)
+	if err != nil {
+		return err
+	}
+	return c.serve(msgs, handle)
+}
+
+// Consume declare the rpc queue of the service called name and start
+// consuming it, the deliveries stop once Cancel is called
+func (c *Connection) Consume(name string) (<-chan amqp.Delivery, error) {
+	// the same durable queue nameko declare, so every instance of the service,
+	// Go or Python, consume from it
 	server, err := c.channel.QueueDeclare(
 		fmt.Sprintf("rpc-%v", name), // queue name
-		false,                       // durable
+		true,                        // durable
 		false,                       // delete when unused
-		true,                        // exclusive
+		false,                       // exclusive
 		false,                       // no-wait
 		nil,                         // arguments
 	)
-	FailOnError(err, "Failed to declare a server queue")
+	if err != nil {
+		return nil, wrapError(ErrDeclare, "Failed to declare a server queue", err)
+	}
 	c.server = server
 
+	prefetch := c.PrefetchCount
+	if prefetch == 0 {
+		prefetch = 10
+	}
 	err = c.channel.Qos(
-		10,    // prefetch count
-		0,     // prefetch size
-		false, // global
+		prefetch, // prefetch count
+		0,        // prefetch size
+		true,     // global
 	)
-	FailOnError(err, "Failed to set server QoS")
+	if err != nil {
+		return nil, wrapError(ErrConsume, "Failed to set server QoS", err)
+	}
 
 	err = c.channel.QueueBind(
-		name,                      // queue name
+		c.server.Name,             // queue name
 		fmt.Sprintf("%v.*", name), // routing key
 		"nameko-rpc",              // exchange
 		false,                     // no-wait
 		nil,                       // args
 	)
-	FailOnError(err, "Failed to bind a queue")
+	if err != nil {
+		return nil, wrapError(ErrDeclare, "Failed to bind a queue", err)
+	}
+
+	msgs, err := c.consume(c.server.Name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf(" [*] Server is waiting...")
+	return msgs, nil
+}
+
+// consume start a consumer on queue with a tag recorded for Cancel
+func (c *Connection) consume(queue string, exclusive bool) (<-chan amqp.Delivery, error) {
+	tag := fmt.Sprintf("%v-%v", queue, uuid.NewV4().String())
 
 	msgs, err := c.channel.Consume(
-		c.server.Name, // queue name
-		"",            // consumer
-		false,         // auto ack
-		true,          // exclusive
-		false,         // no local
-		false,         // no wait
-		nil,           // args
+		queue,     // queue name
+		tag,       // consumer
+		false,     // auto ack
+		exclusive, // exclusive
+		false,     // no local
+		false,     // no wait
+		nil,       // args
 	)
-	FailOnError(err, "Failed to register a consumer")
-
-	forever := make(chan bool)
-
-	go func() {
-		for msg := range msgs {
-			log.Println("Server got rpc message: ", msg)
-			response, _ := json.Marshal(
-				RPCResponse{
-					Result: "hello, nameko!",
-					Err:    nil,
-				},
-			)
-
-			err := c.channel.Publish(
-				"nameko-rpc",
-				msg.ReplyTo,
-				false,
-				false,
-				amqp.Publishing{
-					ContentType:   "application/xjson",
-					CorrelationId: msg.CorrelationId,
-					Body:          response,
-				})
-			FailOnError(err, "Failed to publish a message")
-
-			msg.Ack(false)
+	if err != nil {
+		return nil, wrapError(ErrConsume, "Failed to register a consumer", err)
+	}
+
+	c.mu.Lock()
+	c.consumers = append(c.consumers, tag)
+	c.mu.Unlock()
+
+	return msgs, nil
+}
+
+// serve pass msgs to handle until the consumer stop
+func (c *Connection) serve(msgs <-chan amqp.Delivery, handle func(amqp.Delivery) error) error {
+	for msg := range msgs {
+		if err := handle(msg); err != nil {
+			return err
 		}
-	}()
+	}
 
-	log.Printf(" [*] Server is waiting...")
-	<-forever
+	c.mu.Lock()
+	cancelled := c.cancelled
+	c.mu.Unlock()
+
+	if cancelled {
+		return nil
+	}
+	return wrapError(ErrConsume, "Server consumer closed", amqp.ErrClosed)
+}
+
+// Cancel stop every consumer started by Consume, messages already delivered
+// are still handled, the reply queue keep consuming until Close
+func (c *Connection) Cancel() error {
+	c.mu.Lock()
+	consumers := c.consumers
+	c.consumers = nil
+	c.cancelled = true
+	c.mu.Unlock()
+
+	for _, tag := range consumers {
+		if err := c.channel.Cancel(tag, false); err != nil {
+			return wrapError(ErrConsume, "Failed to cancel a consumer", err)
+		}
+	}
+	return nil
+}
+
+// Close close the connection to RabbitMQ, calls still waiting for a reply
+// fail with ErrConsume
+func (c *Connection) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// declareOnce run declare unless name was already declared on the
+// connection, name is only marked declared once declare succeed
+func (c *Connection) declareOnce(name string, declare func() error) error {
+	c.declareMu.Lock()
+	defer c.declareMu.Unlock()
+
+	if c.declared[name] {
+		return nil
+	}
+	if err := declare(); err != nil {
+		return err
+	}
+
+	if c.declared == nil {
+		c.declared = make(map[string]bool)
+	}
+	c.declared[name] = true
+	return nil
+}
+
+// Reply publish response to the reply queue of the rpc message d
+func (c *Connection) Reply(d amqp.Delivery, response RPCResponse) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	contentType := c.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	err = c.channel.Publish(
+		"nameko-rpc", // exchange
+		d.ReplyTo,    // routing key
+		false,        // mandatory
+		false,        // immediate
+		amqp.Publishing{
+			ContentType:   contentType,
+			CorrelationId: d.CorrelationId,
+			Body:          body,
+		})
+	return wrapError(ErrPublish, "Failed to publish a reply", err)
 }
@@ -0,0 +1,212 @@
+package gonameko
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/streadway/amqp"
+)
+
+// Keys of the context data nameko propagate between services, each one is
+// sent as an AMQP header prefixed with HeaderPrefix
+const (
+	HeaderPrefix = "nameko."
+
+	ContextCallIDStack = "call_id_stack"
+	ContextLanguage    = "language"
+	ContextUserID      = "user_id"
+	ContextUserAgent   = "user_agent"
+	ContextAuthToken   = "auth_token"
+)
+
+// parentCallsTracked is how many parent call ids are kept in a call stack,
+// the same limit as nameko
+const parentCallsTracked = 10
+
+// WorkerContext describe the call a handler is running for, like nameko's
+// WorkerContext. It is also the context.Context of the worker, cancelled when
+// the server give up waiting for it on shutdown.
+type WorkerContext struct {
+	context.Context
+
+	// Service and Method the message was routed to
+	Service, Method string
+	CorrelationID   string
+	ReplyTo         string
+	// CallID identify this call, CallIDStack end with it and start with the
+	// call ids of the callers that led to it
+	CallID      string
+	CallIDStack []string
+
+	Language  string
+	UserID    string
+	UserAgent string
+	AuthToken string
+	// ContextData hold every nameko context value received, keyed without
+	// HeaderPrefix
+	ContextData map[string]interface{}
+	// Headers is the raw AMQP headers of the message
+	Headers amqp.Table
+
+	// RPC call other nameko services over the connection of the server,
+	// passing the worker context as ctx so the call inherit its context data:
+	//
+	//	ctx.RPC.Service("locations").Call(ctx, "get_location", 42)
+	RPC *Client
+
+	dependencies map[string]interface{}
+}
+
+type (
+	workerContextKey struct{}
+	contextDataKey   struct{}
+)
+
+// newWorkerContext build the context of a worker running method of service
+// for the message d
+func newWorkerContext(ctx context.Context, rpc *Client, service, method string, d amqp.Delivery) *WorkerContext {
+	w := &WorkerContext{
+		RPC:           rpc,
+		Context:       ctx,
+		Service:       service,
+		Method:        method,
+		CorrelationID: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		CallID:        fmt.Sprintf("%v.%v.%v", service, method, uuid.NewV4().String()),
+		ContextData:   make(map[string]interface{}),
+		Headers:       d.Headers,
+	}
+
+	for k, v := range d.Headers {
+		if strings.HasPrefix(k, HeaderPrefix) {
+			w.ContextData[strings.TrimPrefix(k, HeaderPrefix)] = v
+		}
+	}
+
+	parents := stringList(w.ContextData[ContextCallIDStack])
+	if len(parents) > parentCallsTracked {
+		parents = parents[len(parents)-parentCallsTracked:]
+	}
+	w.CallIDStack = append(parents, w.CallID)
+	w.ContextData[ContextCallIDStack] = w.CallIDStack
+
+	w.Language, _ = w.ContextData[ContextLanguage].(string)
+	w.UserID, _ = w.ContextData[ContextUserID].(string)
+	w.UserAgent, _ = w.ContextData[ContextUserAgent].(string)
+	w.AuthToken, _ = w.ContextData[ContextAuthToken].(string)
+	return w
+}
+
+// Value make the worker context reachable from contexts derived from it,
+// see WorkerContextFrom
+func (w *WorkerContext) Value(key interface{}) interface{} {
+	if key == (workerContextKey{}) {
+		return w
+	}
+	return w.Context.Value(key)
+}
+
+// WorkerContextFrom return the worker context ctx is, or is derived from
+func WorkerContextFrom(ctx context.Context) (*WorkerContext, bool) {
+	w, ok := ctx.Value(workerContextKey{}).(*WorkerContext)
+	return w, ok
+}
+
+// WithContextData return a copy of ctx carrying data, calls made with it send
+// data as nameko context data on top of what ctx already carry
+func WithContextData(ctx context.Context, data map[string]interface{}) context.Context {
+	merged := make(map[string]interface{})
+	if parent, ok := ctx.Value(contextDataKey{}).(map[string]interface{}); ok {
+		for k, v := range parent {
+			merged[k] = v
+		}
+	}
+	for k, v := range data {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, contextDataKey{}, merged)
+}
+
+// contextHeaders build the nameko headers of a call made with ctx, from the
+// data of the client, then of ctx, then of the call itself. A call made by a
+// worker inherit its context data so the call id stack is extended, otherwise
+// a new stack is started for the caller called name.
+func contextHeaders(ctx context.Context, name string, client, call map[string]interface{}) amqp.Table {
+	data := make(map[string]interface{})
+	for k, v := range client {
+		data[k] = v
+	}
+
+	if w, ok := WorkerContextFrom(ctx); ok {
+		for k, v := range w.ContextData {
+			data[k] = v
+		}
+	} else {
+		data[ContextCallIDStack] = []string{fmt.Sprintf("%v.call.%v", name, uuid.NewV4().String())}
+	}
+
+	if extra, ok := ctx.Value(contextDataKey{}).(map[string]interface{}); ok {
+		for k, v := range extra {
+			data[k] = v
+		}
+	}
+	for k, v := range call {
+		data[k] = v
+	}
+
+	headers := make(amqp.Table, len(data))
+	for k, v := range data {
+		headers[HeaderPrefix+k] = headerValue(v)
+	}
+	return headers
+}
+
+// headerValue convert v to a value amqp.Table accept, lists become
+// []interface{} and dicts become amqp.Table recursively. Any other value is
+// converted through its JSON encoding, as nameko would serialize it.
+func headerValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, byte, int, int16, int32, int64, float32, float64, string, []byte, amqp.Decimal, time.Time:
+		return v
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = headerValue(item)
+		}
+		return values
+	case map[string]interface{}:
+		table := make(amqp.Table, len(v))
+		for k, item := range v {
+			table[k] = headerValue(item)
+		}
+		return table
+	case amqp.Table:
+		return headerValue(map[string]interface{}(v))
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return fmt.Sprint(v)
+	}
+	return headerValue(decoded)
+}
+
+// stringList convert a list header to strings, ignoring other values
+func stringList(v interface{}) []string {
+	items, _ := v.([]interface{})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
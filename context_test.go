@@ -0,0 +1,117 @@
+package gonameko
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+type testLocation struct {
+	City string `json:"city"`
+}
+
+func TestHeaderValue(t *testing.T) {
+	tests := []struct {
+		value, want interface{}
+	}{
+		{"en", "en"},
+		{int64(42), int64(42)},
+		{nil, nil},
+		{[]string{"a", "b"}, []interface{}{"a", "b"}},
+		{[]int{1, 2}, []interface{}{float64(1), float64(2)}},
+		{
+			map[string]interface{}{"tags": []string{"a"}},
+			amqp.Table{"tags": []interface{}{"a"}},
+		},
+		{
+			[]interface{}{map[string]string{"k": "v"}},
+			[]interface{}{amqp.Table{"k": "v"}},
+		},
+		{
+			amqp.Table{"location": testLocation{"Paris"}},
+			amqp.Table{"location": amqp.Table{"city": "Paris"}},
+		},
+	}
+	for _, tt := range tests {
+		got := headerValue(tt.value)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("headerValue(%#v) = %#v, want %#v", tt.value, got, tt.want)
+		}
+		if err := (amqp.Table{"v": got}).Validate(); err != nil {
+			t.Errorf("headerValue(%#v) is not a valid header: %v", tt.value, err)
+		}
+	}
+}
+
+func TestContextHeadersOverride(t *testing.T) {
+	tests := []struct {
+		client, ctx, call map[string]interface{}
+		want              string
+	}{
+		{map[string]interface{}{"language": "en"}, nil, nil, "en"},
+		{map[string]interface{}{"language": "en"}, map[string]interface{}{"language": "fr"}, nil, "fr"},
+		{
+			map[string]interface{}{"language": "en"},
+			map[string]interface{}{"language": "fr"},
+			map[string]interface{}{"language": "de"},
+			"de",
+		},
+		{nil, map[string]interface{}{"language": "fr"}, map[string]interface{}{"user_id": "1"}, "fr"},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.ctx != nil {
+			ctx = WithContextData(ctx, tt.ctx)
+		}
+		headers := contextHeaders(ctx, "caller", tt.client, tt.call)
+		if got := headers[HeaderPrefix+ContextLanguage]; got != tt.want {
+			t.Errorf("language with client %v, ctx %v, call %v = %v, want %v", tt.client, tt.ctx, tt.call, got, tt.want)
+		}
+
+		stack := stringList(headers[HeaderPrefix+ContextCallIDStack])
+		if len(stack) != 1 || !strings.HasPrefix(stack[0], "caller.call.") {
+			t.Errorf("call_id_stack = %v, want a new stack for caller", stack)
+		}
+	}
+}
+
+func TestContextHeadersCallIDStack(t *testing.T) {
+	parents := func(n int) []interface{} {
+		stack := make([]interface{}, n)
+		for i := range stack {
+			stack[i] = fmt.Sprint("parent.", i)
+		}
+		return stack
+	}
+
+	tests := []struct {
+		parents []interface{}
+		want    []string
+	}{
+		{nil, nil},
+		{parents(2), []string{"parent.0", "parent.1"}},
+		{parents(12), stringList(parents(12)[2:])},
+	}
+	for _, tt := range tests {
+		d := amqp.Delivery{Headers: amqp.Table{
+			HeaderPrefix + ContextLanguage: "en",
+		}}
+		if tt.parents != nil {
+			d.Headers[HeaderPrefix+ContextCallIDStack] = tt.parents
+		}
+		w := newWorkerContext(context.Background(), nil, "service", "method", d)
+
+		headers := contextHeaders(w, "service", nil, nil)
+		want := append(tt.want, w.CallID)
+		if got := stringList(headers[HeaderPrefix+ContextCallIDStack]); !reflect.DeepEqual(got, want) {
+			t.Errorf("call_id_stack from %v = %v, want %v", tt.parents, got, want)
+		}
+		if got := headers[HeaderPrefix+ContextLanguage]; got != "en" {
+			t.Errorf("language = %v, want inherited en", got)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package gonameko
+
+import (
+	"context"
+	"fmt"
+)
+
+// DependencyProvider plug a resource such as a DB session or a cache into the
+// workers of a Server, with the same lifecycle as nameko's DependencyProvider
+type DependencyProvider interface {
+	// Setup is called once the server is connected, before it consume
+	Setup(s *Server) error
+	// Start is called once every provider is set up, before the server
+	// consume
+	Start(ctx context.Context) error
+	// Stop is called when the server stop or fail to start, for every
+	// provider whose Setup succeeded and in reverse order. It run once the
+	// workers are finished, or once the shutdown ctx is done in which case
+	// workers may still be running, and before the connection is closed.
+	Stop(ctx context.Context) error
+
+	// GetDependency return the value injected into the worker, it is
+	// available from WorkerContext.Dependency
+	GetDependency(w *WorkerContext) (interface{}, error)
+	// WorkerSetup is called before the handler run
+	WorkerSetup(w *WorkerContext)
+	// WorkerResult is called with the outcome of the handler
+	WorkerResult(w *WorkerContext, result interface{}, err error)
+	// WorkerTeardown is called once the worker is done
+	WorkerTeardown(w *WorkerContext)
+}
+
+// BaseDependency implement every hook of DependencyProvider as a no-op, embed
+// it to only implement the hooks a provider need
+type BaseDependency struct{}
+
+func (BaseDependency) Setup(s *Server) error                                        { return nil }
+func (BaseDependency) Start(ctx context.Context) error                              { return nil }
+func (BaseDependency) Stop(ctx context.Context) error                               { return nil }
+func (BaseDependency) GetDependency(w *WorkerContext) (interface{}, error)          { return nil, nil }
+func (BaseDependency) WorkerSetup(w *WorkerContext)                                 {}
+func (BaseDependency) WorkerResult(w *WorkerContext, result interface{}, err error) {}
+func (BaseDependency) WorkerTeardown(w *WorkerContext)                              {}
+
+// RPCProxy inject a proxy to another nameko service, like nameko's RpcProxy,
+// the dependency is a *ServiceProxy sharing the connection of the server
+type RPCProxy struct {
+	BaseDependency
+
+	Service string
+}
+
+// GetDependency return a proxy to p.Service
+func (p *RPCProxy) GetDependency(w *WorkerContext) (interface{}, error) {
+	return w.RPC.Service(p.Service), nil
+}
+
+// Config inject static configuration values, the dependency is Values
+type Config struct {
+	BaseDependency
+
+	Values map[string]interface{}
+}
+
+// GetDependency return c.Values
+func (c *Config) GetDependency(w *WorkerContext) (interface{}, error) {
+	return c.Values, nil
+}
+
+// namedDependency is a provider added to a server under name
+type namedDependency struct {
+	name     string
+	provider DependencyProvider
+}
+
+// AddDependency add provider to the server, the value it inject in each
+// worker is available as ctx.Dependency(name)
+func (s *Server) AddDependency(name string, provider DependencyProvider) {
+	s.dependencies = append(s.dependencies, namedDependency{name, provider})
+}
+
+// startDependencies set up and then start every provider before the server
+// consume anything. When a provider fail, every provider already set up is
+// stopped.
+func (s *Server) startDependencies(ctx context.Context) error {
+	s.setUp = nil
+	for _, d := range s.dependencies {
+		if err := d.provider.Setup(s); err != nil {
+			s.stopDependencies(ctx)
+			return fmt.Errorf("setup dependency %v: %w", d.name, err)
+		}
+		s.setUp = append(s.setUp, d)
+	}
+
+	for _, d := range s.dependencies {
+		if err := d.provider.Start(ctx); err != nil {
+			s.stopDependencies(ctx)
+			return fmt.Errorf("start dependency %v: %w", d.name, err)
+		}
+	}
+	return nil
+}
+
+// stopDependencies stop the providers set up in reverse order and return the
+// first failure
+func (s *Server) stopDependencies(ctx context.Context) error {
+	var err error
+	for i := len(s.setUp) - 1; i >= 0; i-- {
+		d := s.setUp[i]
+		if stopErr := d.provider.Stop(ctx); stopErr != nil && err == nil {
+			err = fmt.Errorf("stop dependency %v: %w", d.name, stopErr)
+		}
+	}
+	s.setUp = nil
+	return err
+}
+
+// Dependency return the value injected by the provider added as name
+func (w *WorkerContext) Dependency(name string) interface{} {
+	return w.dependencies[name]
+}
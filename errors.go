@@ -0,0 +1,194 @@
+package gonameko
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Sentinel errors for the exceptions raised by nameko itself, a remote error
+// matching one of them satisfies errors.Is
+var (
+	ErrUnknownService     = errors.New("unknown service")
+	ErrMethodNotFound     = errors.New("method not found")
+	ErrIncorrectSignature = errors.New("incorrect signature")
+	ErrMalformedRequest   = errors.New("malformed request")
+)
+
+// Sentinel errors for broker failures, errors.Is(err, ErrPublish) tell which
+// step failed while errors.As still reach the underlying *amqp.Error
+var (
+	ErrConnect = errors.New("gonameko: connect failed")
+	ErrDeclare = errors.New("gonameko: declare failed")
+	ErrPublish = errors.New("gonameko: publish failed")
+	ErrConsume = errors.New("gonameko: consume failed")
+)
+
+// DefaultErrorRegistry is used by clients that do not set their own registry
+var DefaultErrorRegistry = NewErrorRegistry()
+
+// RPCError capture exception from nameko service
+type RPCError struct {
+	ExcType string        `json:"exc_type"`
+	ExcPath string        `json:"exc_path"`
+	ExcArgs []interface{} `json:"exc_args"`
+	Value   string        `json:"value"`
+
+	cause error
+}
+
+// Error represent gonamekoclient customize error
+type Error struct {
+	Type, Value string
+}
+
+// TimeoutError is returned when a call does not get a reply before the
+// deadline of its context
+type TimeoutError struct {
+	Service, Function string
+	Err               error
+}
+
+// ErrorRegistry map nameko exceptions to Go errors, entries are looked up by
+// exc_path first and then by exc_type
+type ErrorRegistry struct {
+	mu           sync.RWMutex
+	constructors map[string]func(*RPCError) error
+}
+
+// BrokerError is returned when talking to RabbitMQ fails, Kind is one of
+// ErrConnect, ErrDeclare, ErrPublish or ErrConsume
+type BrokerError struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+// DecodeError is returned when a reply from nameko cannot be decoded
+type DecodeError struct {
+	Service, Function string
+	Body              []byte
+	Err               error
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%v: %v", e.ExcType, e.Value)
+}
+
+// Unwrap return the sentinel error registered for the exception, if any
+func (e *RPCError) Unwrap() error {
+	return e.cause
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Type, e.Value)
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v.%v: timed out waiting for reply: %v", e.Service, e.Function, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout report whether the error is a timeout, to match net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v.%v: malformed reply %q: %v", e.Service, e.Function, e.Body, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *BrokerError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Msg, e.Err)
+}
+
+func (e *BrokerError) Unwrap() error {
+	return e.Err
+}
+
+// Is report whether target is the kind of e
+func (e *BrokerError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// newNamekoError build the error nameko itself raise as
+// nameko.exceptions.<excType>
+func newNamekoError(excType, value string) *RPCError {
+	return &RPCError{
+		ExcType: excType,
+		ExcPath: "nameko.exceptions." + excType,
+		ExcArgs: []interface{}{value},
+		Value:   value,
+	}
+}
+
+// validate check that a remote error carry at least the exception type
+func (e *RPCError) validate() error {
+	if e.ExcType == "" {
+		return errors.New("error is missing exc_type")
+	}
+	return nil
+}
+
+// NewErrorRegistry return a registry that already know nameko's own
+// UnknownService, MethodNotFound, IncorrectSignature and MalformedRequest
+// exceptions
+func NewErrorRegistry() *ErrorRegistry {
+	r := &ErrorRegistry{constructors: make(map[string]func(*RPCError) error)}
+	r.RegisterSentinel("nameko.exceptions.UnknownService", ErrUnknownService)
+	r.RegisterSentinel("nameko.exceptions.MethodNotFound", ErrMethodNotFound)
+	r.RegisterSentinel("nameko.exceptions.IncorrectSignature", ErrIncorrectSignature)
+	r.RegisterSentinel("nameko.exceptions.MalformedRequest", ErrMalformedRequest)
+	return r
+}
+
+// Register map exc, an exc_path such as "myservice.exceptions.NotFound" or a
+// bare exc_type such as "NotFound", to an error constructor
+func (r *ErrorRegistry) Register(exc string, constructor func(*RPCError) error) {
+	r.mu.Lock()
+	r.constructors[exc] = constructor
+	r.mu.Unlock()
+}
+
+// RegisterSentinel map exc to sentinel, the remote error is still returned as
+// an *RPCError but errors.Is(err, sentinel) report true
+func (r *ErrorRegistry) RegisterSentinel(exc string, sentinel error) {
+	r.Register(exc, func(e *RPCError) error {
+		wrapped := *e
+		wrapped.cause = sentinel
+		return &wrapped
+	})
+}
+
+// Translate return the Go error registered for e, or e itself when the
+// exception is unknown
+func (r *ErrorRegistry) Translate(e *RPCError) error {
+	r.mu.RLock()
+	constructor, ok := r.constructors[e.ExcPath]
+	if !ok {
+		constructor, ok = r.constructors[e.ExcType]
+	}
+	r.mu.RUnlock()
+
+	if !ok {
+		return e
+	}
+	return constructor(e)
+}
+
+// RegisterRemoteError register constructor in DefaultErrorRegistry
+func RegisterRemoteError(exc string, constructor func(*RPCError) error) {
+	DefaultErrorRegistry.Register(exc, constructor)
+}
+
+// RegisterRemoteErrorSentinel register sentinel in DefaultErrorRegistry
+func RegisterRemoteErrorSentinel(exc string, sentinel error) {
+	DefaultErrorRegistry.RegisterSentinel(exc, sentinel)
+}
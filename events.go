@@ -0,0 +1,275 @@
+package gonameko
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/streadway/amqp"
+)
+
+// EventDispatcher publish events of the service called Service, like
+// nameko's event_dispatcher, to be received by `@event_handler`s
+type EventDispatcher struct {
+	Service string
+
+	conn *Connection
+}
+
+// EventDispatcher return a dispatcher of events emitted as service
+func (c *Client) EventDispatcher(service string) *EventDispatcher {
+	return &EventDispatcher{Service: service, conn: c.Conn}
+}
+
+// Dispatch publish payload as an eventType event, the context data carried
+// by ctx is sent along like for calls
+func (e *EventDispatcher) Dispatch(ctx context.Context, eventType string, payload interface{}) error {
+	return e.conn.Dispatch(ctx, e.Service, eventType, payload)
+}
+
+// EventDispatcherProvider inject an *EventDispatcher emitting events as the
+// server, like nameko's EventDispatcher dependency
+type EventDispatcherProvider struct {
+	BaseDependency
+
+	dispatcher *EventDispatcher
+}
+
+// Setup bind the dispatcher to the name and connection of s
+func (p *EventDispatcherProvider) Setup(s *Server) error {
+	p.dispatcher = &EventDispatcher{Service: s.Name, conn: s.Conn}
+	return nil
+}
+
+// GetDependency return the dispatcher of the server
+func (p *EventDispatcherProvider) GetDependency(w *WorkerContext) (interface{}, error) {
+	return p.dispatcher, nil
+}
+
+// eventExchange return the name of the exchange nameko publish the events of
+// service to
+func eventExchange(service string) string {
+	return fmt.Sprintf("%v.events", service)
+}
+
+// Dispatch publish payload as an eventType event of service
+func (c *Connection) Dispatch(ctx context.Context, service, eventType string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	exchange := eventExchange(service)
+	if err := c.declareEventExchange(exchange); err != nil {
+		return err
+	}
+
+	contentType := c.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	err = c.channel.Publish(
+		exchange,  // exchange
+		eventType, // routing key
+		false,     // mandatory
+		false,     // immediate
+		amqp.Publishing{
+			ContentType:  contentType,
+			DeliveryMode: amqp.Persistent,
+			Headers:      contextHeaders(ctx, c.Name, c.ContextData, nil),
+			Body:         body,
+		})
+	return wrapError(ErrPublish, "Failed to publish an event", err)
+}
+
+// declareEventExchange declare the topic exchange of events once per
+// connection
+func (c *Connection) declareEventExchange(exchange string) error {
+	return c.declareOnce(exchange, func() error {
+		err := c.channel.ExchangeDeclare(
+			exchange, // name
+			"topic",  // type
+			true,     // durable
+			false,    // auto-deleted
+			false,    // internal
+			false,    // no-wait
+			nil,      // arguments
+		)
+		return wrapError(ErrDeclare, "Failed to declare an event exchange", err)
+	})
+}
+
+// EventHandlerType choose how the instances of a service share events, as
+// nameko's handler_type
+type EventHandlerType int
+
+const (
+	// ServicePool deliver each event to one instance of the service
+	ServicePool EventHandlerType = iota
+	// Singleton deliver each event to one instance of any service
+	Singleton
+	// Broadcast deliver each event to every instance of the service
+	Broadcast
+)
+
+// EventDelivery choose whether events are kept while no handler consume
+// them, as nameko's reliable_delivery
+type EventDelivery int
+
+const (
+	// ReliableDelivery use a durable queue that outlive its consumers, so
+	// events emitted during an outage are handled once the service is back
+	ReliableDelivery EventDelivery = iota
+	// EphemeralDelivery use a queue deleted with its last consumer, events
+	// emitted while no instance is running are dropped
+	EphemeralDelivery
+)
+
+// EventHandlerFunc handle the payload of an event, it can be decoded with
+// json.Unmarshal into the type the event carry
+type EventHandlerFunc func(ctx *WorkerContext, payload json.RawMessage) error
+
+// EventHandlerOptions configure an event handler of a Server
+type EventHandlerOptions struct {
+	Type EventHandlerType
+	// Method name the handler as a python method would be, it is part of
+	// the queue name so it must match to share a queue with Python
+	// consumers. "handle_<event type>" when not set.
+	Method string
+	// BroadcastIdentifier identify the instance in Broadcast queue names, a
+	// random id when not set. ReliableDelivery of Broadcast events need an
+	// identifier that is stable across restarts.
+	BroadcastIdentifier string
+	// Delivery is ReliableDelivery unless set
+	Delivery EventDelivery
+	// RequeueOnError put an event whose handler failed back on the queue
+	// instead of acking it
+	RequeueOnError bool
+	// Retry failed handlers after a delay, it take precedence over
+	// RequeueOnError for the errors it consider retryable
+	Retry *RetryPolicy
+}
+
+// eventHandler is an event handler registered on a server
+type eventHandler struct {
+	sourceService, eventType string
+	handler                  EventHandlerFunc
+	opts                     EventHandlerOptions
+	randomIdentifier         bool
+}
+
+// HandleEvent subscribe handler to the eventType events of sourceService,
+// declaring and binding its queue the way nameko's event_handler does
+func (s *Server) HandleEvent(sourceService, eventType string, handler EventHandlerFunc, opts EventHandlerOptions) {
+	h := &eventHandler{sourceService: sourceService, eventType: eventType, handler: handler, opts: opts}
+	if h.opts.Method == "" {
+		h.opts.Method = "handle_" + eventType
+	}
+	if h.opts.Type == Broadcast && h.opts.BroadcastIdentifier == "" {
+		h.opts.BroadcastIdentifier = uuid.NewV4().String()
+		h.randomIdentifier = true
+	}
+	s.events = append(s.events, h)
+}
+
+// queue return the name of the queue of h in service
+func (h *eventHandler) queue(service string) string {
+	switch h.opts.Type {
+	case Singleton:
+		return fmt.Sprintf("evt-%v-%v", h.sourceService, h.eventType)
+	case Broadcast:
+		return fmt.Sprintf("evt-%v-%v--%v.%v-%v", h.sourceService, h.eventType, service, h.opts.Method, h.opts.BroadcastIdentifier)
+	default:
+		return fmt.Sprintf("evt-%v-%v--%v.%v", h.sourceService, h.eventType, service, h.opts.Method)
+	}
+}
+
+// consumeEvents start consuming the queue of every event handler
+func (s *Server) consumeEvents() error {
+	for _, h := range s.events {
+		h := h
+		if h.opts.Type == Broadcast && h.opts.Delivery == ReliableDelivery && h.randomIdentifier {
+			return fmt.Errorf("%v.%v: reliable delivery of broadcast events need a BroadcastIdentifier", h.sourceService, h.eventType)
+		}
+
+		ephemeral := h.opts.Delivery == EphemeralDelivery
+		msgs, err := s.Conn.ConsumeEvents(
+			h.sourceService,
+			h.eventType,
+			h.queue(s.Name),
+			ephemeral,                             // delete when unused
+			ephemeral && h.opts.Type == Broadcast, // exclusive
+		)
+		if err != nil {
+			return err
+		}
+		s.serve(msgs, func(d amqp.Delivery) error {
+			return s.handleEvent(h, d)
+		})
+	}
+	return nil
+}
+
+// handleEvent wait for a free worker and run h on it, a failed event is
+// retried, parked or requeued as h is configured and acked otherwise
+func (s *Server) handleEvent(h *eventHandler, d amqp.Delivery) error {
+	s.workers.run(func() {
+		w := newWorkerContext(s.ctx, s.rpc, s.Name, h.opts.Method, d)
+		_, err := s.runWorker(w, func(w *WorkerContext) (_ interface{}, err error) {
+			defer recoverPanic(&err)
+			return nil, h.handler(w, d.Body)
+		})
+		if err != nil {
+			log.Printf("Event handler %v.%v failed: %v", s.Name, h.opts.Method, err)
+
+			switch s.retry(h.opts.Retry, h.queue(s.Name), "", d, err) {
+			case retried:
+				return
+			case notRetried:
+				if h.opts.RequeueOnError {
+					d.Nack(false, true)
+					return
+				}
+			}
+		}
+		d.Ack(false)
+	})
+	return nil
+}
+
+// ConsumeEvents declare queue bound to the eventType events of sourceService
+// and start consuming it, the deliveries stop once Cancel is called
+func (c *Connection) ConsumeEvents(sourceService, eventType, queue string, autoDelete, exclusive bool) (<-chan amqp.Delivery, error) {
+	exchange := eventExchange(sourceService)
+	if err := c.declareEventExchange(exchange); err != nil {
+		return nil, err
+	}
+
+	_, err := c.channel.QueueDeclare(
+		queue,      // queue name
+		true,       // durable
+		autoDelete, // delete when unused
+		exclusive,  // exclusive
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		return nil, wrapError(ErrDeclare, "Failed to declare an event queue", err)
+	}
+
+	err = c.channel.QueueBind(
+		queue,     // queue name
+		eventType, // routing key
+		exchange,  // exchange
+		false,     // no-wait
+		nil,       // args
+	)
+	if err != nil {
+		return nil, wrapError(ErrDeclare, "Failed to bind an event queue", err)
+	}
+
+	return c.consume(queue, exclusive)
+}
@@ -0,0 +1,29 @@
+package gonameko
+
+import "testing"
+
+func TestEventHandlerQueue(t *testing.T) {
+	tests := []struct {
+		opts EventHandlerOptions
+		want string
+	}{
+		{
+			EventHandlerOptions{Type: ServicePool, Method: "handle_created"},
+			"evt-orders-order_created--payments.handle_created",
+		},
+		{
+			EventHandlerOptions{Type: Singleton, Method: "handle_created"},
+			"evt-orders-order_created",
+		},
+		{
+			EventHandlerOptions{Type: Broadcast, Method: "handle_created", BroadcastIdentifier: "host-1"},
+			"evt-orders-order_created--payments.handle_created-host-1",
+		},
+	}
+	for _, tt := range tests {
+		h := &eventHandler{sourceService: "orders", eventType: "order_created", opts: tt.opts}
+		if got := h.queue("payments"); got != tt.want {
+			t.Errorf("queue() with type %v = %v, want %v", tt.opts.Type, got, tt.want)
+		}
+	}
+}
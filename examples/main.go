@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 
 	"github.com/iamdavidzeng/gonameko"
 )
@@ -14,14 +15,16 @@ func main() {
 		RabbitPort:     5672,
 		ContentType:    "application/json",
 	}
-	client.Setup()
+	if err := client.Setup(); err != nil {
+		log.Fatal(err)
+	}
 
 	response, err := client.Call(gonameko.RPCRequestParam{
 		Service:  "locations",
 		Function: "health_check",
 		Payload: gonameko.RPCPayload{
-			Args:   []string{},
-			Kwargs: map[string]string{},
+			Args:   []interface{}{},
+			Kwargs: map[string]interface{}{},
 		},
 	})
 	if err != nil {
@@ -38,5 +41,8 @@ func main() {
 		RabbitPort:     5672,
 		ContentType:    "application/json",
 	}
-	server.Run()
+	server.Register("hello", func(ctx *gonameko.WorkerContext, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+		return fmt.Sprintf("hello, %v!", args[0]), nil
+	})
+	log.Fatal(server.Run())
 }
@@ -0,0 +1,167 @@
+package gonameko
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"unicode"
+)
+
+// Handler implement a rpc method, args and kwargs are decoded from the
+// request and the returned value is encoded as the result
+type Handler func(ctx *WorkerContext, args []interface{}, kwargs map[string]interface{}) (interface{}, error)
+
+// Exception can be implemented by handler errors to choose the exc_type and
+// exc_path reported to nameko callers, other errors are reported under their
+// Go type name
+type Exception interface {
+	error
+	ExcType() string
+	ExcPath() string
+}
+
+// PanicError is reported to the caller when a handler panics, the worker
+// itself recover and keep serving
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// rpcRequest is the body of a nameko rpc message, arguments are kept raw so
+// each entrypoint can decode them into the types it needs
+type rpcRequest struct {
+	Args   []json.RawMessage          `json:"args"`
+	Kwargs map[string]json.RawMessage `json:"kwargs"`
+}
+
+// decodeRequest decode the body of a rpc message. Like nameko, only a body
+// that is not a json object with both args and kwargs is a MalformedRequest,
+// args that are not a list or kwargs that are not an object cannot be passed
+// to any method and are reported as IncorrectSignature.
+func decodeRequest(body []byte) (*rpcRequest, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, newNamekoError("MalformedRequest", fmt.Sprintf("Message body is not valid: %v", err))
+	}
+	rawArgs, hasArgs := fields["args"]
+	rawKwargs, hasKwargs := fields["kwargs"]
+	if !hasArgs || !hasKwargs {
+		return nil, newNamekoError("MalformedRequest", "Message missing `args` or `kwargs`")
+	}
+
+	req := &rpcRequest{}
+	if err := json.Unmarshal(rawArgs, &req.Args); err != nil || req.Args == nil {
+		return nil, newNamekoError("IncorrectSignature", "args must be a list")
+	}
+	if err := json.Unmarshal(rawKwargs, &req.Kwargs); err != nil || req.Kwargs == nil {
+		return nil, newNamekoError("IncorrectSignature", "kwargs must be an object")
+	}
+	return req, nil
+}
+
+// entrypoint run one rpc method for a decoded request
+type entrypoint func(ctx *WorkerContext, req *rpcRequest) (interface{}, error)
+
+func (h Handler) entrypoint() entrypoint {
+	return func(ctx *WorkerContext, req *rpcRequest) (interface{}, error) {
+		args := make([]interface{}, len(req.Args))
+		for i, raw := range req.Args {
+			if err := json.Unmarshal(raw, &args[i]); err != nil {
+				return nil, err
+			}
+		}
+
+		kwargs := make(map[string]interface{}, len(req.Kwargs))
+		for k, raw := range req.Kwargs {
+			var v interface{}
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return nil, err
+			}
+			kwargs[k] = v
+		}
+
+		return h(ctx, args, kwargs)
+	}
+}
+
+// call run e and turn a panic into a *PanicError
+func (e entrypoint) call(ctx *WorkerContext, req *rpcRequest) (result interface{}, err error) {
+	defer recoverPanic(&err)
+	return e(ctx, req)
+}
+
+// recoverPanic must be deferred by the function running a handler, it turn a
+// panic into a *PanicError stored in err
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+		log.Printf("Recovered from handler panic: %v\n%s", r, panicErr.Stack)
+		*err = panicErr
+	}
+}
+
+// newResponse encode the outcome of an entrypoint in nameko's reply format
+func newResponse(result interface{}, err error) RPCResponse {
+	if err != nil {
+		return RPCResponse{Err: newRPCError(err)}
+	}
+
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return RPCResponse{Err: newRPCError(fmt.Errorf("failed to encode result: %w", err))}
+	}
+	return RPCResponse{Result: raw}
+}
+
+// newRPCError convert err into the error object sent back to the caller the
+// way nameko serialize exceptions, an *RPCError is sent as it is
+func newRPCError(err error) *RPCError {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+
+	rpcErr = &RPCError{
+		ExcArgs: []interface{}{err.Error()},
+		Value:   err.Error(),
+	}
+
+	var exc Exception
+	if errors.As(err, &exc) {
+		rpcErr.ExcType, rpcErr.ExcPath = exc.ExcType(), exc.ExcPath()
+		return rpcErr
+	}
+
+	rpcErr.ExcType, rpcErr.ExcPath = "Exception", "builtins.Exception"
+
+	t := reflect.TypeOf(err)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if isApplicationType(t) {
+		rpcErr.ExcType = t.Name()
+		rpcErr.ExcPath = t.PkgPath() + "." + t.Name()
+	}
+	return rpcErr
+}
+
+// isApplicationType report whether t is an exported type of package main or
+// outside of the standard library, whose name is meaningful to a caller.
+// Errors built with errors.New or fmt.Errorf are reported as a plain
+// Exception instead.
+func isApplicationType(t reflect.Type) bool {
+	name := t.Name()
+	if name == "" || !unicode.IsUpper([]rune(name)[0]) {
+		return false
+	}
+	root := strings.SplitN(t.PkgPath(), "/", 2)[0]
+	return root == "main" || strings.Contains(root, ".")
+}
@@ -0,0 +1,60 @@
+package gonameko
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type testError struct{}
+
+func (testError) Error() string { return "test error" }
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		body string
+		want error
+	}{
+		{`{"args": [], "kwargs": {}}`, nil},
+		{`{"args": [1, "a"], "kwargs": {"b": null}}`, nil},
+		{`{"args": []}`, ErrMalformedRequest},
+		{`{"kwargs": {}}`, ErrMalformedRequest},
+		{`[]`, ErrMalformedRequest},
+		{`not json`, ErrMalformedRequest},
+		{`{"args": null, "kwargs": {}}`, ErrIncorrectSignature},
+		{`{"args": {}, "kwargs": {}}`, ErrIncorrectSignature},
+		{`{"args": [], "kwargs": null}`, ErrIncorrectSignature},
+	}
+	for _, tt := range tests {
+		_, err := decodeRequest([]byte(tt.body))
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("decodeRequest(%v) error = %v", tt.body, err)
+			}
+		} else if !errors.Is(DefaultErrorRegistry.Translate(newRPCError(err)), tt.want) {
+			t.Errorf("decodeRequest(%v) error = %v, want %v", tt.body, err, tt.want)
+		}
+	}
+}
+
+func TestNewRPCError(t *testing.T) {
+	tests := []struct {
+		err              error
+		excType, excPath string
+	}{
+		{errors.New("boom"), "Exception", "builtins.Exception"},
+		{fmt.Errorf("wrapped: %w", errors.New("boom")), "Exception", "builtins.Exception"},
+		{testError{}, "Exception", "builtins.Exception"},
+		{&PanicError{Value: "boom"}, "PanicError", "github.com/iamdavidzeng/gonameko.PanicError"},
+		{newNamekoError("MethodNotFound", "x"), "MethodNotFound", "nameko.exceptions.MethodNotFound"},
+	}
+	for _, tt := range tests {
+		got := newRPCError(tt.err)
+		if got.ExcType != tt.excType || got.ExcPath != tt.excPath {
+			t.Errorf("newRPCError(%v) = %v %v, want %v %v", tt.err, got.ExcType, got.ExcPath, tt.excType, tt.excPath)
+		}
+		if got.Value != tt.err.Error() && got != tt.err {
+			t.Errorf("newRPCError(%v).Value = %q", tt.err, got.Value)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package gonameko
+
+import "context"
+
+// Kwargs hold keyword arguments of a proxy call, it can be passed anywhere
+// among the positional args and is merged into the payload kwargs
+type Kwargs map[string]interface{}
+
+// ServiceProxy build calls to the methods of one nameko service
+type ServiceProxy struct {
+	Name string
+
+	client *Client
+}
+
+// MethodProxy build calls to one method of a nameko service
+type MethodProxy struct {
+	Service, Name string
+
+	client *Client
+}
+
+// Service return a proxy to the nameko service called name, like
+// `rpc.<name>` in nameko
+func (c *Client) Service(name string) *ServiceProxy {
+	return &ServiceProxy{Name: name, client: c}
+}
+
+// Method return a proxy to the method called name
+func (s *ServiceProxy) Method(name string) *MethodProxy {
+	return &MethodProxy{Service: s.Name, Name: name, client: s.client}
+}
+
+// Call invoke method with args, see MethodProxy.Call
+func (s *ServiceProxy) Call(ctx context.Context, method string, args ...interface{}) (interface{}, error) {
+	return s.Method(method).Call(ctx, args...)
+}
+
+// Param build the RPCRequestParam for a call with args, values of type Kwargs
+// become keyword arguments and everything else is positional
+func (m *MethodProxy) Param(args ...interface{}) RPCRequestParam {
+	payload := RPCPayload{
+		Args:   []interface{}{},
+		Kwargs: map[string]interface{}{},
+	}
+	for _, arg := range args {
+		kwargs, ok := arg.(Kwargs)
+		if !ok {
+			payload.Args = append(payload.Args, arg)
+			continue
+		}
+		for k, v := range kwargs {
+			payload.Kwargs[k] = v
+		}
+	}
+
+	return RPCRequestParam{
+		Service:  m.Service,
+		Function: m.Name,
+		Payload:  payload,
+	}
+}
+
+// Call invoke the method and wait for its result
+func (m *MethodProxy) Call(ctx context.Context, args ...interface{}) (interface{}, error) {
+	return m.client.CallContext(ctx, m.Param(args...))
+}
+
+// CallInto invoke the method and decode its result into out
+func (m *MethodProxy) CallInto(ctx context.Context, out interface{}, args ...interface{}) error {
+	return m.client.CallInto(ctx, m.Param(args...), out)
+}
+
+// CallAsync invoke the method without waiting for its result, ctx only
+// provide the context data of the call
+func (m *MethodProxy) CallAsync(ctx context.Context, args ...interface{}) *Reply {
+	return m.client.CallAsyncContext(ctx, m.Param(args...))
+}
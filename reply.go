@@ -0,0 +1,164 @@
+package gonameko
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Reply is a handle to the outcome of an asynchronous call, the result can be
+// collected with Result once Done is closed
+type Reply struct {
+	Service, Function string
+
+	correlationID string
+	dispatcher    *replyDispatcher
+	done          chan struct{}
+	delivery      amqp.Delivery
+	useNumber     bool
+	registry      *ErrorRegistry
+
+	once   sync.Once
+	raw    json.RawMessage
+	result interface{}
+	err    error
+}
+
+// failedReply return a Reply that is already done with err, for calls that
+// could not be published
+func failedReply(p RPCRequestParam, err error) *Reply {
+	reply := &Reply{
+		Service:  p.Service,
+		Function: p.Function,
+		done:     make(chan struct{}),
+	}
+	reply.once.Do(func() { reply.err = err })
+	close(reply.done)
+	return reply
+}
+
+// Done return a channel that is closed when the reply arrives
+func (r *Reply) Done() <-chan struct{} {
+	return r.done
+}
+
+// Result wait for the reply and return the decoded result or remote error.
+// If ctx is done first the reply is abandoned and any late response dropped.
+func (r *Reply) Result(ctx context.Context) (interface{}, error) {
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		if r.dispatcher != nil {
+			r.dispatcher.unregister(r.correlationID)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &TimeoutError{r.Service, r.Function, ctx.Err()}
+		}
+		return nil, ctx.Err()
+	}
+
+	r.once.Do(r.decode)
+	return r.result, r.err
+}
+
+// ResultInto wait for the reply like Result and decode the result into out,
+// which must be a pointer as for json.Unmarshal
+func (r *Reply) ResultInto(ctx context.Context, out interface{}) error {
+	if _, err := r.Result(ctx); err != nil {
+		return err
+	}
+	if len(r.raw) == 0 {
+		return nil
+	}
+	return decodeJSON(r.raw, out, r.useNumber)
+}
+
+func (r *Reply) decode() {
+	response := &RPCResponse{}
+	if err := decodeJSON(r.delivery.Body, response, r.useNumber); err != nil {
+		r.err = &DecodeError{r.Service, r.Function, r.delivery.Body, err}
+		return
+	}
+
+	if response.Err != nil {
+		if err := response.Err.validate(); err != nil {
+			r.err = &DecodeError{r.Service, r.Function, r.delivery.Body, err}
+			return
+		}
+		r.err = r.registry.Translate(response.Err)
+		return
+	}
+
+	r.raw = response.Result
+	if len(r.raw) == 0 {
+		return
+	}
+	r.err = decodeJSON(r.raw, &r.result, r.useNumber)
+}
+
+// replyDispatcher route deliveries from the reply queue to waiting callers
+// by correlation id
+type replyDispatcher struct {
+	mu      sync.Mutex
+	pending map[string]*Reply
+}
+
+func newReplyDispatcher() *replyDispatcher {
+	return &replyDispatcher{pending: make(map[string]*Reply)}
+}
+
+// register reserve a reply slot for reply, it is released when the reply
+// arrives or by unregister once the caller stop waiting
+func (r *replyDispatcher) register(reply *Reply) {
+	reply.dispatcher = r
+	reply.done = make(chan struct{})
+
+	r.mu.Lock()
+	r.pending[reply.correlationID] = reply
+	r.mu.Unlock()
+}
+
+func (r *replyDispatcher) unregister(correlationID string) {
+	r.mu.Lock()
+	delete(r.pending, correlationID)
+	r.mu.Unlock()
+}
+
+// listen consume msgs until the channel is closed, every delivery is acked
+// whether or not someone is still waiting for it. Callers still waiting when
+// the channel close get an error.
+func (r *replyDispatcher) listen(msgs <-chan amqp.Delivery) {
+	defer r.fail(wrapError(ErrConsume, "Reply consumer closed", amqp.ErrClosed))
+
+	for d := range msgs {
+		r.mu.Lock()
+		reply, ok := r.pending[d.CorrelationId]
+		delete(r.pending, d.CorrelationId)
+		r.mu.Unlock()
+
+		d.Ack(false)
+
+		if !ok {
+			log.Printf("Dropped reply with unknown correlation id %v", d.CorrelationId)
+			continue
+		}
+		reply.delivery = d
+		close(reply.done)
+	}
+}
+
+// fail resolve every pending reply with err
+func (r *replyDispatcher) fail(err error) {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[string]*Reply)
+	r.mu.Unlock()
+
+	for _, reply := range pending {
+		reply.once.Do(func() { reply.err = err })
+		close(reply.done)
+	}
+}
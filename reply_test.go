@@ -0,0 +1,132 @@
+package gonameko
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func newTestReply(correlationID string) *Reply {
+	return &Reply{Service: "test", Function: "method", correlationID: correlationID}
+}
+
+func replyDelivery(correlationID string, result int) amqp.Delivery {
+	return amqp.Delivery{
+		CorrelationId: correlationID,
+		Body:          []byte(fmt.Sprintf(`{"result": %v, "error": null}`, result)),
+	}
+}
+
+func waitReply(t *testing.T, reply *Reply) {
+	t.Helper()
+	select {
+	case <-reply.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("reply %v not done", reply.correlationID)
+	}
+}
+
+func TestReplyDispatcherOutOfOrder(t *testing.T) {
+	dispatcher := newReplyDispatcher()
+	msgs := make(chan amqp.Delivery)
+	go dispatcher.listen(msgs)
+	defer close(msgs)
+
+	replies := make([]*Reply, 5)
+	for i := range replies {
+		replies[i] = newTestReply(fmt.Sprint(i))
+		dispatcher.register(replies[i])
+	}
+	for i := len(replies) - 1; i >= 0; i-- {
+		msgs <- replyDelivery(fmt.Sprint(i), i)
+	}
+
+	for i, reply := range replies {
+		waitReply(t, reply)
+		result, err := reply.Result(context.Background())
+		if err != nil || result != float64(i) {
+			t.Errorf("reply %v = %v, %v, want %v", i, result, err, i)
+		}
+	}
+}
+
+func TestReplyDispatcherUnknownCorrelationID(t *testing.T) {
+	dispatcher := newReplyDispatcher()
+	msgs := make(chan amqp.Delivery)
+	go dispatcher.listen(msgs)
+	defer close(msgs)
+
+	reply := newTestReply("known")
+	dispatcher.register(reply)
+
+	msgs <- replyDelivery("unknown", 1)
+	msgs <- replyDelivery("known", 2)
+
+	waitReply(t, reply)
+	if result, err := reply.Result(context.Background()); err != nil || result != float64(2) {
+		t.Errorf("reply = %v, %v, want 2", result, err)
+	}
+}
+
+func TestReplyDispatcherLateReply(t *testing.T) {
+	dispatcher := newReplyDispatcher()
+	msgs := make(chan amqp.Delivery)
+	go dispatcher.listen(msgs)
+	defer close(msgs)
+
+	reply := newTestReply("late")
+	dispatcher.register(reply)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err := reply.Result(ctx)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Result() error = %v, want *TimeoutError", err)
+	}
+
+	msgs <- replyDelivery("late", 1)
+	// a second send only go through once the late reply is handled
+	msgs <- replyDelivery("other", 2)
+
+	select {
+	case <-reply.Done():
+		t.Error("abandoned reply got the late response")
+	default:
+	}
+
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	if len(dispatcher.pending) != 0 {
+		t.Errorf("pending = %v, want none", dispatcher.pending)
+	}
+}
+
+func TestReplyDispatcherFail(t *testing.T) {
+	dispatcher := newReplyDispatcher()
+	msgs := make(chan amqp.Delivery)
+	done := make(chan struct{})
+	go func() {
+		dispatcher.listen(msgs)
+		close(done)
+	}()
+
+	replies := []*Reply{newTestReply("a"), newTestReply("b")}
+	for _, reply := range replies {
+		dispatcher.register(reply)
+	}
+	close(msgs)
+	<-done
+
+	for _, reply := range replies {
+		waitReply(t, reply)
+		_, err := reply.Result(context.Background())
+		if !errors.Is(err, ErrConsume) {
+			t.Errorf("reply %v error = %v, want ErrConsume", reply.correlationID, err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package gonameko
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers recording the retries of a message
+const (
+	// AttemptHeader count the attempts made to handle a message, it is
+	// missing on the first one
+	AttemptHeader = "gonameko.attempt"
+	// RoutingKeyHeader keep the original routing key of a parked message,
+	// which is replaced when it is published to the parking lot
+	RoutingKeyHeader = "gonameko.routing_key"
+)
+
+// DefaultMaxAttempts is used when RetryPolicy.MaxAttempts is not set
+const DefaultMaxAttempts = 3
+
+// maxRetryDelay is the longest TTL RabbitMQ accept on a queue
+const maxRetryDelay = time.Duration(math.MaxInt32) * time.Millisecond
+
+// RetryPolicy retry a failed handler after a delay growing exponentially.
+// A message waiting for its retry is held in a queue with a TTL that
+// dead-letter it back where it came from, a message still failing after
+// MaxAttempts is moved to the parking-lot queue `<queue>.parking-lot`.
+type RetryPolicy struct {
+	// MaxAttempts count every attempt including the first one,
+	// DefaultMaxAttempts when not set
+	MaxAttempts int
+	// InitialDelay is the delay before the first retry
+	InitialDelay time.Duration
+	// MaxDelay cap the delay, no cap when not set
+	MaxDelay time.Duration
+	// Multiplier grow the delay between retries, 2 when not set
+	Multiplier float64
+	// Retryable report whether err is worth retrying, every error except
+	// nameko's MethodNotFound, MalformedRequest and IncorrectSignature when
+	// not set
+	Retryable func(err error) bool
+}
+
+// retryOutcome tell what retry did with a failed message
+type retryOutcome int
+
+const (
+	notRetried retryOutcome = iota
+	retried
+	parked
+)
+
+// delay return how long to wait before attempt+1
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	maxDelay := maxRetryDelay
+	if p.MaxDelay > 0 && p.MaxDelay < maxDelay {
+		maxDelay = p.MaxDelay
+	}
+
+	// computed as a float so that a long run of retries cannot overflow
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	switch {
+	case delay > float64(maxDelay) || math.IsNaN(delay):
+		return maxDelay
+	case delay < 0:
+		return 0
+	}
+	return time.Duration(delay)
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) {
+		return true
+	}
+	switch rpcErr.ExcPath {
+	case "nameko.exceptions.MethodNotFound",
+		"nameko.exceptions.MalformedRequest",
+		"nameko.exceptions.IncorrectSignature":
+		return false
+	}
+	return true
+}
+
+// retry hand d, consumed from queue, to the retry queue when policy allow
+// another attempt after err, in which case d is acked and later dead-lettered
+// to exchange. A message out of attempts is copied to the parking lot but is
+// left for the caller to settle.
+func (s *Server) retry(policy *RetryPolicy, queue, exchange string, d amqp.Delivery, err error) retryOutcome {
+	if policy == nil || !policy.retryable(err) {
+		return notRetried
+	}
+
+	attempt := deliveryAttempt(d)
+	if attempt >= policy.maxAttempts() {
+		if err := s.Conn.Park(queue, d, attempt); err != nil {
+			log.Printf("Failed to park message from %v: %v", queue, err)
+			return notRetried
+		}
+		log.Printf("Parked message from %v after %v attempts", queue, attempt)
+		return parked
+	}
+
+	if err := s.Conn.Retry(queue, exchange, d, attempt+1, policy.delay(attempt)); err != nil {
+		log.Printf("Failed to retry message from %v: %v", queue, err)
+		return notRetried
+	}
+	d.Ack(false)
+	return retried
+}
+
+// deliveryAttempt return which attempt at handling d this is
+func deliveryAttempt(d amqp.Delivery) int {
+	switch attempt := d.Headers[AttemptHeader].(type) {
+	case int32:
+		return int(attempt)
+	case int64:
+		return int(attempt)
+	case int:
+		return attempt
+	}
+	return 1
+}
+
+// Retry republish d, consumed from queue, to be dead-lettered to exchange
+// after delay as its attempt-th attempt. The message keep its routing key so
+// it is routed again like the original one, except through the default
+// exchange where it goes straight back to queue.
+func (c *Connection) Retry(queue, exchange string, d amqp.Delivery, attempt int, delay time.Duration) error {
+	ms := delay.Milliseconds()
+	retry := fmt.Sprintf("%v.retry.%v", queue, ms)
+
+	args := amqp.Table{
+		"x-message-ttl":          ms,
+		"x-dead-letter-exchange": exchange,
+	}
+	if exchange == "" {
+		args["x-dead-letter-routing-key"] = queue
+	}
+	if err := c.declareRetry(retry, args); err != nil {
+		return err
+	}
+	return c.republish(retry, d.RoutingKey, d, attempt, nil)
+}
+
+// Park publish d, consumed from queue, to the parking-lot queue of queue
+// where it stay until an operator deal with it
+func (c *Connection) Park(queue string, d amqp.Delivery, attempt int) error {
+	parkingLot := fmt.Sprintf("%v.parking-lot", queue)
+
+	if err := c.declareQueue(parkingLot, nil); err != nil {
+		return err
+	}
+	return c.republish("", parkingLot, d, attempt, amqp.Table{
+		RoutingKeyHeader: d.RoutingKey,
+	})
+}
+
+// declareQueue declare a durable queue once per connection
+func (c *Connection) declareQueue(queue string, args amqp.Table) error {
+	return c.declareOnce(queue, func() error {
+		_, err := c.channel.QueueDeclare(
+			queue, // queue name
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			args,  // arguments
+		)
+		return wrapError(ErrDeclare, "Failed to declare a queue", err)
+	})
+}
+
+// declareRetry declare once per connection the retry queue name with args and
+// a fanout exchange of the same name delivering to it whatever the routing key
+func (c *Connection) declareRetry(name string, args amqp.Table) error {
+	return c.declareOnce(name, func() error {
+		err := c.channel.ExchangeDeclare(
+			name,     // name
+			"fanout", // type
+			true,     // durable
+			false,    // auto-deleted
+			false,    // internal
+			false,    // no-wait
+			nil,      // arguments
+		)
+		if err != nil {
+			return wrapError(ErrDeclare, "Failed to declare a retry exchange", err)
+		}
+
+		_, err = c.channel.QueueDeclare(
+			name,  // queue name
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			args,  // arguments
+		)
+		if err != nil {
+			return wrapError(ErrDeclare, "Failed to declare a retry queue", err)
+		}
+
+		err = c.channel.QueueBind(
+			name,  // queue name
+			"",    // routing key
+			name,  // exchange
+			false, // no-wait
+			nil,   // arguments
+		)
+		return wrapError(ErrDeclare, "Failed to bind a retry queue", err)
+	})
+}
+
+// republish copy d to exchange with key, recording attempt and extra in the
+// headers
+func (c *Connection) republish(exchange, key string, d amqp.Delivery, attempt int, extra amqp.Table) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+	headers[AttemptHeader] = int64(attempt)
+
+	err := c.channel.Publish(
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		amqp.Publishing{
+			Headers:       headers,
+			ContentType:   d.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+			Body:          d.Body,
+		})
+	return wrapError(ErrPublish, "Failed to republish a message", err)
+}
@@ -0,0 +1,36 @@
+package gonameko
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{RetryPolicy{InitialDelay: time.Second}, 1, time.Second},
+		{RetryPolicy{InitialDelay: time.Second}, 3, 4 * time.Second},
+		{RetryPolicy{InitialDelay: time.Second, Multiplier: 3}, 3, 9 * time.Second},
+		{RetryPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second}, 4, 5 * time.Second},
+		{RetryPolicy{InitialDelay: time.Second}, 80, maxRetryDelay},
+		{RetryPolicy{InitialDelay: time.Second, MaxDelay: time.Duration(1 << 62)}, 80, maxRetryDelay},
+		{RetryPolicy{InitialDelay: -time.Second}, 1, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.delay(tt.attempt); got != tt.want {
+			t.Errorf("%+v.delay(%v) = %v, want %v", tt.policy, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyMaxAttempts(t *testing.T) {
+	if got := (&RetryPolicy{}).maxAttempts(); got != DefaultMaxAttempts {
+		t.Errorf("maxAttempts() = %v, want %v", got, DefaultMaxAttempts)
+	}
+	if got := (&RetryPolicy{MaxAttempts: 5}).maxAttempts(); got != 5 {
+		t.Errorf("maxAttempts() = %v, want 5", got)
+	}
+}
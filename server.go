@@ -1,5 +1,22 @@
 package gonameko
 
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DefaultShutdownTimeout is how long Run wait for in-flight workers when
+// ShutdownTimeout is not set
+const DefaultShutdownTimeout = 30 * time.Second
+
 type Server struct {
 	Name string
 
@@ -8,11 +25,91 @@ type Server struct {
 	RabbitPass     string
 	RabbitPort     int64
 	ContentType    string
+	// MaxWorkers limit how many messages are handled concurrently, like
+	// nameko's max_workers, DefaultMaxWorkers when not set
+	MaxWorkers int
+	// ShutdownTimeout bound how long Run wait for in-flight workers once it
+	// is asked to stop, DefaultShutdownTimeout when not set
+	ShutdownTimeout time.Duration
+	// Retry failed rpc handlers, the caller get the error once the attempts
+	// are exhausted. No retry when nil.
+	Retry *RetryPolicy
 
 	Conn *Connection
+
+	methods      map[string]entrypoint
+	events       []*eventHandler
+	timers       []*timer
+	dependencies []namedDependency
+	setUp        []namedDependency
+
+	workers  *workerPool
+	rpc      *Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	errs     chan error
+	stopping chan struct{}
+	stopOnce *sync.Once
+	serving  sync.WaitGroup
+}
+
+// Register expose handler as the rpc method called method, it is reached by
+// nameko callers as `<server name>.<method>`
+func (s *Server) Register(method string, handler Handler) {
+	s.register(method, handler.entrypoint())
+}
+
+func (s *Server) register(method string, e entrypoint) {
+	if s.methods == nil {
+		s.methods = make(map[string]entrypoint)
+	}
+	s.methods[method] = e
+}
+
+// Run serve rpc messages until the process receive SIGINT or SIGTERM or
+// consuming fails, then stop gracefully
+func (s *Server) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return s.RunContext(ctx)
 }
 
-func (s *Server) Run() {
+// RunContext serve rpc messages until ctx is done or consuming fails, then
+// stop gracefully within ShutdownTimeout
+func (s *Server) RunContext(ctx context.Context) error {
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-s.errs:
+	}
+
+	timeout := s.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	stopCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if stopErr := s.Stop(stopCtx); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// Start connect to RabbitMQ, start consuming rpc messages and events and
+// start the timers without blocking, Stop must be called to release the
+// connection
+func (s *Server) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.stopOnce = &sync.Once{}
 	s.Conn = &Connection{
 		Name:           s.Name,
 		RabbitHostname: s.RabbitHostname,
@@ -20,7 +117,145 @@ func (s *Server) Run() {
 		RabbitPass:     s.RabbitPass,
 		RabbitPort:     s.RabbitPort,
 		ContentType:    s.ContentType,
+		PrefetchCount:  s.maxWorkers(),
+	}
+	s.workers = newWorkerPool(s.maxWorkers())
+	s.rpc = &Client{Conn: s.Conn}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.errs = make(chan error, 1)
+	s.stopping = make(chan struct{})
+
+	if err := s.Conn.Declare(); err != nil {
+		s.Conn.Close()
+		return err
+	}
+
+	if err := s.startDependencies(ctx); err != nil {
+		s.Conn.Close()
+		return err
+	}
+
+	msgs, err := s.Conn.Consume(s.Name)
+	if err != nil {
+		s.Stop(ctx)
+		return err
+	}
+	s.serve(msgs, s.handle)
+
+	if err := s.consumeEvents(); err != nil {
+		s.Stop(ctx)
+		return err
+	}
+
+	s.startTimers()
+	return nil
+}
+
+// Stop cancel the consumers and timers, wait for in-flight workers to reply
+// and close the connection. Once ctx is done the workers are told to give up
+// through their context and the connection is closed anyway. Only the first
+// call stop the server, later ones return nil.
+func (s *Server) Stop(ctx context.Context) error {
+	if s.Conn == nil {
+		return nil
+	}
+
+	var err error
+	s.stopOnce.Do(func() {
+		err = s.stop(ctx)
+	})
+	return err
+}
+
+func (s *Server) stop(ctx context.Context) error {
+	close(s.stopping)
+	err := s.Conn.Cancel()
+	waitErr := waitContext(ctx, &s.serving)
+	if waitErr == nil {
+		waitErr = s.workers.wait(ctx)
+	}
+	if waitErr != nil {
+		log.Printf("Stopped with workers still running: %v", waitErr)
+		if err == nil {
+			err = waitErr
+		}
+	}
+	s.cancel()
+
+	if stopErr := s.stopDependencies(ctx); err == nil {
+		err = stopErr
+	}
+
+	if closeErr := s.Conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// serve pass msgs to handle in the background, a consumer failure is
+// reported to RunContext
+func (s *Server) serve(msgs <-chan amqp.Delivery, handle func(amqp.Delivery) error) {
+	s.serving.Add(1)
+	go func() {
+		defer s.serving.Done()
+		if err := s.Conn.serve(msgs, handle); err != nil {
+			select {
+			case s.errs <- err:
+			default:
+			}
+		}
+	}()
+}
+
+func (s *Server) maxWorkers() int {
+	if s.MaxWorkers > 0 {
+		return s.MaxWorkers
+	}
+	return DefaultMaxWorkers
+}
+
+// handle wait for a free worker and dispatch d on it, d is acked only once
+// its reply is published. A message without reply_to cannot be answered and
+// is rejected without requeue.
+func (s *Server) handle(d amqp.Delivery) error {
+	if d.ReplyTo == "" {
+		log.Printf("Rejected rpc message %v without reply_to", d.RoutingKey)
+		return d.Reject(false)
+	}
+
+	s.workers.run(func() {
+		result, err := s.dispatch(d)
+		if err != nil && s.retry(s.Retry, s.Conn.server.Name, "nameko-rpc", d, err) == retried {
+			return
+		}
+		response := newResponse(result, err)
+
+		if err := s.Conn.Reply(d, response); err != nil {
+			log.Printf("Failed to reply to %v: %v", d.RoutingKey, err)
+			d.Nack(false, true)
+			return
+		}
+		d.Ack(false)
+	})
+	return nil
+}
+
+// MethodNotFound, MalformedRequest or IncorrectSignature before any handler run
+// MethodNotFound or MalformedRequest before any handler run
+func (s *Server) dispatch(d amqp.Delivery) (interface{}, error) {
+	method := d.RoutingKey[strings.LastIndex(d.RoutingKey, ".")+1:]
+
+	e, ok := s.methods[method]
+	if !ok || d.RoutingKey != s.Name+"."+method {
+		return nil, newNamekoError("MethodNotFound", method)
+	}
+
+	req, err := decodeRequest(d.Body)
+	if err != nil {
+		return nil, err
 	}
-	s.Conn.Declare()
-	s.Conn.Serve(s.Name)
+	w := newWorkerContext(s.ctx, s.rpc, s.Name, method, d)
+	return s.runWorker(w, func(w *WorkerContext) (interface{}, error) {
+		return e.call(w, req)
+	})
 }
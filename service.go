@@ -0,0 +1,207 @@
+package gonameko
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+var (
+	contextType       = reflect.TypeOf((*context.Context)(nil)).Elem()
+	workerContextType = reflect.TypeOf((*WorkerContext)(nil))
+	errorType         = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterService expose every exported method of svc as a rpc method named
+// in snake_case, e.g. HealthCheck is reachable as `<server name>.health_check`.
+//
+// A method may take a *WorkerContext or a context.Context first, the other
+// parameters are filled from the positional args in order. Keyword args can
+// only fill a trailing struct or map parameter, which is then left out of the
+// positional args. A struct parameter need at least one keyword arg, use a
+// pointer to a struct or a map for optional keyword args.
+// A method may return nothing, a result, an error, or a result and an error.
+func (s *Server) RegisterService(svc interface{}) error {
+	v := reflect.ValueOf(svc)
+	t := v.Type()
+	if t.NumMethod() == 0 {
+		return fmt.Errorf("%v has no exported methods", t)
+	}
+
+	methods := make(map[string]entrypoint, t.NumMethod())
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		e, err := newServiceMethod(snakeCase(m.Name), v.Method(i))
+		if err != nil {
+			return fmt.Errorf("%v.%v: %w", t, m.Name, err)
+		}
+		methods[snakeCase(m.Name)] = e.call
+	}
+
+	for name, e := range methods {
+		s.register(name, e)
+	}
+	return nil
+}
+
+// serviceMethod adapt a Go method to an entrypoint
+type serviceMethod struct {
+	name      string
+	fn        reflect.Value
+	takesCtx  bool
+	params    []reflect.Type
+	kwargsIdx int
+}
+
+func newServiceMethod(name string, fn reflect.Value) (*serviceMethod, error) {
+	t := fn.Type()
+	if t.IsVariadic() {
+		return nil, fmt.Errorf("variadic methods are not supported")
+	}
+
+	switch {
+	case t.NumOut() > 2,
+		t.NumOut() == 2 && t.Out(1) != errorType:
+		return nil, fmt.Errorf("must return at most a result and an error")
+	}
+
+	m := &serviceMethod{name: name, fn: fn, kwargsIdx: -1}
+	for i := 0; i < t.NumIn(); i++ {
+		if i == 0 && (t.In(i) == contextType || t.In(i) == workerContextType) {
+			m.takesCtx = true
+			continue
+		}
+		m.params = append(m.params, t.In(i))
+	}
+
+	if n := len(m.params); n > 0 && acceptsKwargs(m.params[n-1]) {
+		m.kwargsIdx = n - 1
+	}
+	return m, nil
+}
+
+// acceptsKwargs report whether a parameter of type t can be filled from a
+// json object of keyword args
+func acceptsKwargs(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct ||
+		t.Kind() == reflect.Map && t.Key().Kind() == reflect.String
+}
+
+func (m *serviceMethod) call(ctx *WorkerContext, req *rpcRequest) (interface{}, error) {
+	in, err := m.arguments(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.takesCtx {
+		in = append([]reflect.Value{reflect.ValueOf(ctx)}, in...)
+	}
+	return m.results(m.fn.Call(in))
+}
+
+// arguments decode req onto the parameters of the method, a mismatch is
+// reported as nameko's IncorrectSignature
+func (m *serviceMethod) arguments(req *rpcRequest) ([]reflect.Value, error) {
+	positional := len(m.params)
+	kwargsFilled := m.kwargsIdx >= 0 && len(req.Args) < len(m.params)
+	if kwargsFilled {
+		positional--
+	}
+
+	if len(req.Args) > len(m.params) || len(req.Args) < positional {
+		return nil, newNamekoError("IncorrectSignature", fmt.Sprintf(
+			"%v() takes %v positional arguments but %v were given", m.name, positional, len(req.Args)))
+	}
+	if len(req.Kwargs) > 0 && !kwargsFilled {
+		return nil, newNamekoError("IncorrectSignature", fmt.Sprintf(
+			"%v() got unexpected keyword arguments", m.name))
+	}
+	if kwargsFilled && len(req.Kwargs) == 0 && m.params[m.kwargsIdx].Kind() == reflect.Struct {
+		return nil, newNamekoError("IncorrectSignature", fmt.Sprintf(
+			"%v() missing required keyword arguments", m.name))
+	}
+
+	in := make([]reflect.Value, len(m.params))
+	for i, raw := range req.Args {
+		v := reflect.New(m.params[i])
+		if err := json.Unmarshal(raw, v.Interface()); err != nil {
+			return nil, newNamekoError("IncorrectSignature", fmt.Sprintf(
+				"%v() argument %v: %v", m.name, i, err))
+		}
+		in[i] = v.Elem()
+	}
+
+	if kwargsFilled {
+		v, err := m.kwargs(req.Kwargs)
+		if err != nil {
+			return nil, err
+		}
+		in[m.kwargsIdx] = v
+	}
+	return in, nil
+}
+
+func (m *serviceMethod) kwargs(kwargs map[string]json.RawMessage) (reflect.Value, error) {
+	t := m.params[m.kwargsIdx]
+	v := reflect.New(t)
+	if len(kwargs) == 0 {
+		return v.Elem(), nil
+	}
+
+	raw, err := json.Marshal(kwargs)
+	if err != nil {
+		return v, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v.Interface()); err != nil {
+		return v, newNamekoError("IncorrectSignature", fmt.Sprintf(
+			"%v() keyword arguments: %v", m.name, err))
+	}
+	return v.Elem(), nil
+}
+
+func (m *serviceMethod) results(out []reflect.Value) (interface{}, error) {
+	switch len(out) {
+	case 0:
+		return nil, nil
+	case 1:
+		if m.fn.Type().Out(0) == errorType {
+			err, _ := out[0].Interface().(error)
+			return nil, err
+		}
+		return out[0].Interface(), nil
+	default:
+		err, _ := out[1].Interface().(error)
+		return out[0].Interface(), err
+	}
+}
+
+// snakeCase convert a Go method name to the python convention, keeping
+// acronyms and their plural together: GetHTTPStatus become get_http_status
+// and ListURLs become list_urls
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			plural := i+1 < len(runes) && runes[i+1] == 's' &&
+				(i+2 == len(runes) || !unicode.IsLower(runes[i+2]))
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && nextLower && !plural {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
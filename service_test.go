@@ -0,0 +1,94 @@
+package gonameko
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type testService struct{}
+
+type testOptions struct {
+	Limit int `json:"limit"`
+}
+
+func (testService) Add(a, b int) int { return a + b }
+
+func (testService) Search(ctx context.Context, query string, opts testOptions) (string, error) {
+	return fmt.Sprintf("%v:%v", query, opts.Limit), nil
+}
+
+func (testService) Filter(ctx *WorkerContext, opts *testOptions) int {
+	if opts == nil {
+		return -1
+	}
+	return opts.Limit
+}
+
+func (testService) Fail() error { return errors.New("failed") }
+
+func TestSnakeCase(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"HealthCheck", "health_check"},
+		{"GetHTTPStatus", "get_http_status"},
+		{"URLs", "urls"},
+		{"ListURLs", "list_urls"},
+		{"GetURLsByID", "get_urls_by_id"},
+		{"IDs", "ids"},
+		{"HTTPServer", "http_server"},
+		{"Add", "add"},
+	}
+	for _, tt := range tests {
+		if got := snakeCase(tt.name); got != tt.want {
+			t.Errorf("snakeCase(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterService(t *testing.T) {
+	s := &Server{}
+	if err := s.RegisterService(testService{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, body string
+		want         interface{}
+		wantErr      string
+	}{
+		{"add", `{"args": [1, 2], "kwargs": {}}`, 3, ""},
+		{"add", `{"args": [1], "kwargs": {}}`, nil, "IncorrectSignature"},
+		{"add", `{"args": [1, 2, 3], "kwargs": {}}`, nil, "IncorrectSignature"},
+		{"add", `{"args": ["1", 2], "kwargs": {}}`, nil, "IncorrectSignature"},
+		{"add", `{"args": [1, 2], "kwargs": {"c": 3}}`, nil, "IncorrectSignature"},
+		{"search", `{"args": ["go"], "kwargs": {"limit": 5}}`, "go:5", ""},
+		{"search", `{"args": ["go", {"limit": 5}], "kwargs": {}}`, "go:5", ""},
+		{"search", `{"args": ["go"], "kwargs": {}}`, nil, "IncorrectSignature"},
+		{"search", `{"args": ["go"], "kwargs": {"offset": 1}}`, nil, "IncorrectSignature"},
+		{"filter", `{"args": [], "kwargs": {}}`, -1, ""},
+		{"filter", `{"args": [], "kwargs": {"limit": 2}}`, 2, ""},
+		{"fail", `{"args": [], "kwargs": {}}`, nil, "Exception"},
+	}
+	for _, tt := range tests {
+		req, err := decodeRequest([]byte(tt.body))
+		if err != nil {
+			t.Fatalf("%v %v: %v", tt.method, tt.body, err)
+		}
+		w := &WorkerContext{Context: context.Background()}
+		got, err := s.methods[tt.method].call(w, req)
+
+		if tt.wantErr != "" {
+			if err == nil || newRPCError(err).ExcType != tt.wantErr {
+				t.Errorf("%v %v: error = %v, want %v", tt.method, tt.body, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v %v = %v, %v, want %v", tt.method, tt.body, got, err, tt.want)
+		}
+	}
+}
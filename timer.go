@@ -0,0 +1,94 @@
+package gonameko
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// TimerFunc is run periodically by a Server
+type TimerFunc func(ctx *WorkerContext) error
+
+// TimerOptions configure a periodic handler of a Server
+type TimerOptions struct {
+	// Method name the timer in its worker context, "timer" when not set
+	Method string
+	// Eager run the handler as soon as the server start instead of waiting
+	// for the first interval, like nameko's eager timers
+	Eager bool
+	// SkipIfBusy skip a tick while the previous run is still in progress,
+	// otherwise every tick run the handler
+	SkipIfBusy bool
+}
+
+// timer is a periodic handler registered on a server
+type timer struct {
+	interval time.Duration
+	handler  TimerFunc
+	opts     TimerOptions
+	busy     int32
+}
+
+// Every run handler every interval on the worker pool of the server, like
+// nameko's @timer. Timers stop ticking when the server stop and their
+// running handlers are waited for like rpc handlers.
+func (s *Server) Every(interval time.Duration, handler TimerFunc, opts TimerOptions) error {
+	if interval <= 0 {
+		return fmt.Errorf("timer interval must be positive, got %v", interval)
+	}
+	if opts.Method == "" {
+		opts.Method = "timer"
+	}
+	s.timers = append(s.timers, &timer{interval: interval, handler: handler, opts: opts})
+	return nil
+}
+
+// startTimers tick every timer until the server stop
+func (s *Server) startTimers() {
+	for _, t := range s.timers {
+		t := t
+		s.serving.Add(1)
+		go func() {
+			defer s.serving.Done()
+
+			ticker := time.NewTicker(t.interval)
+			defer ticker.Stop()
+
+			if t.opts.Eager {
+				s.tick(t)
+			}
+			for {
+				select {
+				case <-s.stopping:
+					return
+				case <-ticker.C:
+					s.tick(t)
+				}
+			}
+		}()
+	}
+}
+
+// tick run t on a free worker unless it is busy and ask to skip
+func (s *Server) tick(t *timer) {
+	if t.opts.SkipIfBusy && !atomic.CompareAndSwapInt32(&t.busy, 0, 1) {
+		log.Printf("Skipped timer %v.%v, previous run still in progress", s.Name, t.opts.Method)
+		return
+	}
+
+	s.workers.run(func() {
+		defer atomic.StoreInt32(&t.busy, 0)
+
+		w := newWorkerContext(s.ctx, s.rpc, s.Name, t.opts.Method, amqp.Delivery{})
+		_, err := s.runWorker(w, func(w *WorkerContext) (_ interface{}, err error) {
+			defer recoverPanic(&err)
+			return nil, t.handler(w)
+		})
+		if err != nil {
+			log.Printf("Timer %v.%v failed: %v", s.Name, t.opts.Method, err)
+		}
+	})
+}
@@ -1,9 +1,51 @@
 package gonameko
 
-import "log"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+)
 
+// FailOnError exit the process when err is not nil, the library itself
+// return errors instead so this is only kept for applications using it
 func FailOnError(err error, msg string) {
 	if err != nil {
 		log.Fatalf("%s: %s", msg, err)
 	}
 }
+
+// decodeJSON unmarshal data into v, numbers decoded into interface{} are kept
+// as json.Number when useNumber is set
+func decodeJSON(data []byte, v interface{}, useNumber bool) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if useNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(v)
+}
+
+// wrapError wrap err as a *BrokerError of kind, it return nil for a nil err
+func wrapError(kind error, msg string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &BrokerError{Kind: kind, Msg: msg, Err: err}
+}
+
+// waitContext wait for wg like wg.Wait but give up once ctx is done
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,70 @@
+package gonameko
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultMaxWorkers is the number of concurrent workers of a Server when
+// MaxWorkers is not set, the same default as nameko's max_workers
+const DefaultMaxWorkers = 10
+
+// workerPool bound the number of handlers running at once
+type workerPool struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newWorkerPool(size int) *workerPool {
+	return &workerPool{slots: make(chan struct{}, size)}
+}
+
+// run block until a worker is free and then run fn on it
+func (p *workerPool) run(fn func()) {
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-p.slots
+			p.wg.Done()
+		}()
+		fn()
+	}()
+}
+
+// wait block until every running worker has finished or ctx is done
+func (p *workerPool) wait(ctx context.Context) error {
+	return waitContext(ctx, &p.wg)
+}
+
+// runWorker inject the dependencies of s into w and run fn between the worker
+// hooks of every provider, a panic of fn or of a hook is returned as a
+// *PanicError
+func (s *Server) runWorker(w *WorkerContext, fn func(*WorkerContext) (interface{}, error)) (result interface{}, err error) {
+	defer recoverPanic(&err)
+
+	w.dependencies = make(map[string]interface{}, len(s.dependencies))
+	for _, d := range s.dependencies {
+		value, err := d.provider.GetDependency(w)
+		if err != nil {
+			return nil, err
+		}
+		w.dependencies[d.name] = value
+	}
+
+	for _, d := range s.dependencies {
+		d.provider.WorkerSetup(w)
+	}
+	defer func() {
+		for _, d := range s.dependencies {
+			d.provider.WorkerTeardown(w)
+		}
+	}()
+
+	result, err = fn(w)
+	for _, d := range s.dependencies {
+		d.provider.WorkerResult(w, result, err)
+	}
+	return result, err
+}